@@ -26,10 +26,16 @@
 //
 // This can then e.g. be copy-pasted into a source file to define a local
 // interface type (and optionally trimmed down to remove unused methods).
+//
+// Arguments are resolved as Go packages using the same rules as the go
+// command, so module-relative import paths and relative paths such as
+// "./internal/foo" both work, and the result takes build tags, GOFLAGS and
+// the current module into account.
 package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"go/ast"
@@ -39,20 +45,36 @@ import (
 	"go/types"
 	"log"
 	"os"
+	"path/filepath"
 	"sort"
 	"strings"
+	"unicode"
 
-	"golang.org/x/tools/go/loader"
+	"golang.org/x/tools/go/ast/astutil"
+	"golang.org/x/tools/go/packages"
 )
 
 type argType struct {
 	pkg string
 	typ string
+	// targs is the raw, comma-separated contents of a trailing [...] on the
+	// command line, e.g. "int" for "mymod/queue.Queue[int]"; empty if none.
+	targs string
 }
 
 var comments = flag.Bool("comments", false, "Include doc comments from first type")
 var header = flag.Bool("header", false, "Include header comment about implementing types")
 var private = flag.Bool("private", false, "Include private methods")
+var tags = flag.String("tags", "", "Comma-separated list of build tags to apply when loading packages")
+var overlay = flag.String("overlay", "", "JSON `file` of package file overlays, in the same format as 'go build -overlay'")
+var outFile = flag.String("o", "", "Write a complete, gofmt'd Go source `file` defining the interface, instead of printing it to stdout")
+var typeName = flag.String("name", "", "Name of the generated interface type (required with -o)")
+var outPackage = flag.String("package", "", "Package name for the file written by -o (default: the name of its directory)")
+var fakeName = flag.String("fake", "", "Also generate a counterfeiter-style test double named `Name` implementing the interface (requires -o)")
+var fakePackage = flag.String("fake-package", "", "Package name for the file written by -o when -fake is given (default: -package)")
+var find = flag.String("find", "", "Comma-separated `packages` to scan for exported types implementing the computed interface")
+var embed = flag.Bool("embed", false, "Factor out embedded interfaces, rather than listing every method explicitly")
+var embedFrom = flag.String("embed-from", "", "Comma-separated `packages` to restrict -embed candidates to (default: every loaded package)")
 
 func main() {
 	flag.Usage = usage
@@ -62,47 +84,346 @@ func main() {
 		flag.Usage()
 		os.Exit(1)
 	}
+	if *outFile != "" && *typeName == "" {
+		log.Fatal("-name is required when -o is given")
+	}
+	if *fakeName != "" && *outFile == "" {
+		log.Fatal("-fake requires -o")
+	}
+	if *embedFrom != "" && !*embed {
+		log.Fatal("-embed-from requires -embed")
+	}
 
-	// Figure out what package and type names were passed on the command line.
+	// Figure out what package and type names were passed on the command line,
+	// and which package patterns need to be loaded to resolve them.
 	argTypes := []argType{}
-	conf := &loader.Config{}
-	if *comments {
-		conf.ParserMode |= parser.ParseComments
-	}
+	patterns := []string{}
 	for _, arg := range flag.Args() {
-		idx := strings.LastIndexByte(arg, '.')
+		// Split off a trailing [T1, T2, ...] type-argument list, if any.
+		head, targs := arg, ""
+		if i := strings.IndexByte(arg, '['); i >= 0 {
+			if !strings.HasSuffix(arg, "]") {
+				log.Fatalf("Malformed type arguments in %q", arg)
+			}
+			head, targs = arg[:i], arg[i+1:len(arg)-1]
+		}
+
+		idx := strings.LastIndexByte(head, '.')
 		if idx < 1 {
 			log.Fatalf("Expected [pkg].[type], not %q", arg)
 		}
-		pkg, typ := arg[:idx], arg[idx+1:]
-		argTypes = append(argTypes, argType{pkg, typ})
+		pkg, typ := head[:idx], head[idx+1:]
+		argTypes = append(argTypes, argType{pkg, typ, targs})
+		patterns = append(patterns, pkg)
 
-		// Add to packages to load.
-		conf.Import(pkg)
+		// Package-qualified type arguments, such as the "io" in
+		// "mymod/queue.Queue[io.Reader]", need their package loaded too, so
+		// resolveTypeExpr can find it later.
+		if targs != "" {
+			argPkgs, err := typeArgPackages(targs)
+			if err != nil {
+				log.Fatalf("Malformed type arguments in %q: %v", arg, err)
+			}
+			patterns = append(patterns, argPkgs...)
+		}
 	}
 
-	// Load all relevant packages.
-	prog, err := conf.Load()
+	// -find and -embed-from need their listed packages loaded too, even
+	// though they don't contribute any types to the interface computation
+	// itself.
+	findPkgs := splitPackageList(*find, &patterns)
+	embedFromPkgs := splitPackageList(*embedFrom, &patterns)
+
+	// Load all relevant packages, modules-aware.
+	cfg := &packages.Config{
+		Mode: packages.NeedName | packages.NeedTypes | packages.NeedTypesInfo |
+			packages.NeedSyntax | packages.NeedImports | packages.NeedDeps,
+	}
+	if *tags != "" {
+		cfg.BuildFlags = append(cfg.BuildFlags, "-tags", *tags)
+	}
+	if *overlay != "" {
+		var err error
+		cfg.Overlay, err = loadOverlay(*overlay)
+		if err != nil {
+			log.Fatalf("Error loading -overlay: %v", err)
+		}
+	}
+	pkgs, err := packages.Load(cfg, patterns...)
 	if err != nil {
 		log.Fatalf("Error loading packages: %v", err)
 	}
+	if packages.PrintErrors(pkgs) > 0 {
+		os.Exit(1)
+	}
+
+	// Index every loaded package (including dependencies) by both its import
+	// path and its *types.Package, so we can look types up by the pattern the
+	// user gave us and later map a types.Object back to its syntax.
+	byPath := map[string]*packages.Package{}
+	byTypes := map[*types.Package]*packages.Package{}
+	packages.Visit(pkgs, func(pkg *packages.Package) bool {
+		byPath[pkg.PkgPath] = pkg
+		if pkg.Types != nil {
+			byTypes[pkg.Types] = pkg
+		}
+		return true
+	}, nil)
+	// Also index the roots by the pattern that produced them, since a
+	// relative pattern like "./foo" isn't the same string as its import path.
+	for i, pattern := range patterns {
+		if _, ok := byPath[pattern]; !ok && i < len(pkgs) {
+			byPath[pattern] = pkgs[i]
+		}
+	}
+
+	// Index loaded packages by name too, to resolve package-qualified type
+	// arguments such as the "io" in "mymod/queue.Queue[io.Reader]".
+	byName := map[string]*types.Package{}
+	for _, pkg := range byTypes {
+		byName[pkg.Types.Name()] = pkg.Types
+	}
 
 	// Get a list of relevant types.
 	typs := []types.Type{}
 	for _, argType := range argTypes {
-		pkg := prog.Imported[argType.pkg]
-		obj := pkg.Pkg.Scope().Lookup(argType.typ)
+		pkg := byPath[argType.pkg]
+		if pkg == nil || pkg.Types == nil {
+			log.Fatalf("Lookup of package %q failed", argType.pkg)
+		}
+		obj := pkg.Types.Scope().Lookup(argType.typ)
 		if obj == nil {
 			log.Fatalf("Lookup of %q failed", argType.pkg+"."+argType.typ)
 		}
-		typ, ok := obj.Type().(*types.Named)
+		named, ok := obj.Type().(*types.Named)
 		if !ok {
 			log.Fatalf("%q is not a declared type, it's a %q", obj, obj.Type())
 		}
+
+		var typ types.Type = named
+		if tparams := named.TypeParams(); tparams != nil && tparams.Len() > 0 {
+			inst, err := instantiate(named, argType.targs, pkg.Types, byName)
+			if err != nil {
+				log.Fatalf("%s: %v", argType.pkg+"."+argType.typ, err)
+			}
+			typ = inst
+		} else if argType.targs != "" {
+			log.Fatalf("%s is not generic, but type arguments were given", argType.pkg+"."+argType.typ)
+		}
 		typs = append(typs, typ)
 	}
 
 	// Get the common methods shared by all specified types.
+	common := commonMethods(typs, *private)
+
+	// Create a sorted list of method names.
+	names := make([]string, 0, len(common))
+	for name := range common {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if len(findPkgs) > 0 {
+		findImplementors(buildInterface(common), findPkgs, byPath)
+	}
+
+	// Factor out embedded interfaces, if requested. This only changes how the
+	// method set is rendered below; common itself keeps every method, since
+	// -header and -find reason about the full, unfactored interface.
+	var embeds []embedCandidate
+	printNames, printCommon := names, common
+	if *embed {
+		candidates := gatherEmbedCandidates(embedFromPkgs, byPath, byTypes)
+		var remaining map[string]fn
+		embeds, remaining = factorEmbeds(common, candidates)
+		printCommon = remaining
+		printNames = make([]string, 0, len(remaining))
+		for name := range remaining {
+			printNames = append(printNames, name)
+		}
+		sort.Strings(printNames)
+	}
+
+	if *outFile != "" {
+		if err := writeFile(*outFile, *outPackage, *typeName, *fakeName, *fakePackage, common, printCommon, printNames, embeds, typs, byTypes); err != nil {
+			log.Fatalf("Error writing %s: %v", *outFile, err)
+		}
+		return
+	}
+
+	// Prepare a buffer for the output.
+	buf := &bytes.Buffer{}
+
+	// Add a package header to get a complete package.
+	fmt.Fprintln(buf, `package common;type T interface{`)
+
+	// Add the embedded interfaces, then the remaining methods explicitly.
+	for _, e := range embeds {
+		fmt.Fprintln(buf, e.qualifiedName((*types.Package).Name))
+	}
+	for _, name := range printNames {
+		method := printCommon[name]
+
+		// Add doc comment, if requested.
+		if *comments {
+			pos := method.Obj.Pos()
+			if pkg := byTypes[method.Obj.Pkg()]; pkg != nil {
+				if doc := enclosingDoc(pkg, pos); doc != nil {
+					for _, comment := range doc.List {
+						fmt.Fprintln(buf, comment.Text)
+					}
+				}
+			}
+		}
+
+		// Add the function signature.
+		sig := types.TypeString(method.Signature, (*types.Package).Name)
+		fmt.Fprintf(buf, "\t%s%s\n", name, strings.TrimPrefix(sig, "func"))
+	}
+
+	fmt.Fprintln(buf, `}`)
+
+	// Pretty-print the buffer, unless we get an error.
+	src := buf.Bytes()
+	if src2, err := format.Source(src); err == nil {
+		src = src2
+	}
+
+	// Remove package header again so only the interface type itself remains.
+	idx := bytes.Index(src, []byte("interface"))
+	if idx >= 0 {
+		src = src[idx:]
+	}
+
+	// Print a header, if requested.
+	if *header {
+		fmt.Println("// Common interface of")
+		for _, line := range implementorLines(common, typs) {
+			fmt.Printf("// %s\n", line)
+		}
+	}
+
+	// Print the result.
+	fmt.Printf("%s", src)
+}
+
+// embedCandidate is a named interface found while scanning for -embed
+// candidates, whose entire method set might be factored out of a computed
+// interface as an embedded field.
+type embedCandidate struct {
+	pkg   *types.Package
+	name  string
+	iface *types.Interface
+}
+
+// qualifiedName renders the candidate as it should appear as an embedded
+// field, e.g. "io.Reader".
+func (e embedCandidate) qualifiedName(qualify types.Qualifier) string {
+	if q := qualify(e.pkg); q != "" {
+		return q + "." + e.name
+	}
+	return e.name
+}
+
+// gatherEmbedCandidates collects every exported named interface type with at
+// least one method from the scopes of pkgPaths, or from every loaded package
+// if pkgPaths is empty.
+func gatherEmbedCandidates(pkgPaths []string, byPath map[string]*packages.Package, byTypes map[*types.Package]*packages.Package) []embedCandidate {
+	var pkgs []*types.Package
+	if len(pkgPaths) > 0 {
+		for _, path := range pkgPaths {
+			if pkg := byPath[path]; pkg != nil && pkg.Types != nil {
+				pkgs = append(pkgs, pkg.Types)
+			}
+		}
+	} else {
+		for tp := range byTypes {
+			pkgs = append(pkgs, tp)
+		}
+	}
+
+	var candidates []embedCandidate
+	for _, pkg := range pkgs {
+		scope := pkg.Scope()
+		for _, name := range scope.Names() {
+			if !ast.IsExported(name) {
+				continue
+			}
+			tn, ok := scope.Lookup(name).(*types.TypeName)
+			if !ok {
+				continue
+			}
+			iface, ok := tn.Type().Underlying().(*types.Interface)
+			if !ok || iface.NumMethods() == 0 {
+				continue
+			}
+			candidates = append(candidates, embedCandidate{pkg, name, iface})
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].pkg.Path() != candidates[j].pkg.Path() {
+			return candidates[i].pkg.Path() < candidates[j].pkg.Path()
+		}
+		return candidates[i].name < candidates[j].name
+	})
+	return candidates
+}
+
+// factorEmbeds greedily picks the largest candidates whose entire method set
+// is present, with identical signatures, among common's still-unclaimed
+// methods, and returns them alongside the methods that remain unclaimed.
+func factorEmbeds(common map[string]fn, candidates []embedCandidate) (embeds []embedCandidate, remaining map[string]fn) {
+	remaining = make(map[string]fn, len(common))
+	for k, v := range common {
+		remaining[k] = v
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].iface.NumMethods() > candidates[j].iface.NumMethods()
+	})
+
+	for _, c := range candidates {
+		if !coveredBy(c.iface, remaining) {
+			continue
+		}
+		for i, n := 0, c.iface.NumMethods(); i < n; i++ {
+			delete(remaining, c.iface.Method(i).Name())
+		}
+		embeds = append(embeds, c)
+	}
+
+	sort.Slice(embeds, func(i, j int) bool {
+		if embeds[i].pkg.Path() != embeds[j].pkg.Path() {
+			return embeds[i].pkg.Path() < embeds[j].pkg.Path()
+		}
+		return embeds[i].name < embeds[j].name
+	})
+	return embeds, remaining
+}
+
+// coveredBy reports whether every method of iface is present in remaining
+// with an identical signature.
+func coveredBy(iface *types.Interface, remaining map[string]fn) bool {
+	for i, n := 0, iface.NumMethods(); i < n; i++ {
+		m := iface.Method(i)
+		if !ast.IsExported(m.Name()) {
+			return false
+		}
+		have, ok := remaining[m.Name()]
+		if !ok || !types.Identical(have.Signature, m.Type().(*types.Signature)) {
+			return false
+		}
+	}
+	return true
+}
+
+// commonMethods computes the methods shared, with identical signatures, by
+// every type in typs. Any element of typs that is neither a pointer nor an
+// interface is replaced in place with a pointer to it, since that may
+// enlarge its method set. If private is false, only exported methods are
+// considered.
+func commonMethods(typs []types.Type, private bool) map[string]fn {
 	var common map[string]fn
 	for ti, t := range typs {
 		// Wrap the type in a pointer if it might enlarge the method set.
@@ -118,7 +439,7 @@ func main() {
 			method := ms.At(i)
 			obj := method.Obj()
 			name := obj.Name()
-			if *private || ast.IsExported(name) {
+			if private || ast.IsExported(name) {
 				sigs[name] = fn{method.Type().(*types.Signature), obj}
 			}
 		}
@@ -129,96 +450,441 @@ func main() {
 		} else {
 			// Remove all methods not implemented by the later type.
 			for k, v := range common {
-				if s, ok := sigs[k]; !ok || !types.Identical(v.Signature, s.Signature) {
+				s, ok := sigs[k]
+				// Unexported methods are only the same method if they also
+				// come from the same package; a private foo() on two types
+				// from different packages is never interchangeable.
+				samePkg := ast.IsExported(k) || v.Obj.Pkg() == s.Obj.Pkg()
+				if !ok || !samePkg || !types.Identical(v.Signature, s.Signature) {
 					delete(common, k)
 				}
 			}
 		}
 	}
+	return common
+}
 
-	// Create a sorted list of method names.
-	names := make([]string, 0, len(common))
-	for name := range common {
-		names = append(names, name)
+// buildInterface constructs the *types.Interface formed by common, for use
+// with types.Implements.
+func buildInterface(common map[string]fn) *types.Interface {
+	funcs := []*types.Func{}
+	// Iterating the map directly is fine because order doesn't matter here.
+	// (NewInterface sorts the methods)
+	for name, method := range common {
+		funcs = append(funcs, types.NewFunc(token.NoPos, nil, name, method.Signature))
 	}
-	sort.Strings(names)
+	return types.NewInterface(funcs, nil).Complete()
+}
 
-	// Prepare a buffer for the output.
-	buf := &bytes.Buffer{}
+// implementorLines renders, one per element of typs, the type that satisfies
+// the interface formed by common, preferring an unwrapped value type over a
+// pointer type when the value type already implements it.
+func implementorLines(common map[string]fn, typs []types.Type) []string {
+	iface := buildInterface(common)
 
-	// Add a package header to get a complete package.
-	fmt.Fprintln(buf, `package common;type T interface{`)
+	lines := make([]string, len(typs))
+	for i, typ := range typs {
+		// Don't print a pointer type if the element type implements the interface.
+		if ptr, ok := typ.(*types.Pointer); ok && types.Implements(ptr.Elem(), iface) {
+			typ = ptr.Elem()
+		}
+		lines[i] = fmt.Sprint(typ)
+	}
+	return lines
+}
 
-	// Add the methods.
-	for _, name := range names {
-		method := common[name]
+// findImplementors scans the scope of each package named in pkgPaths for
+// exported named types that implement iface, either directly or via a
+// pointer receiver, and prints them grouped by package.
+func findImplementors(iface *types.Interface, pkgPaths []string, byPath map[string]*packages.Package) {
+	for _, path := range pkgPaths {
+		pkg := byPath[path]
+		if pkg == nil || pkg.Types == nil {
+			log.Fatalf("Lookup of package %q failed", path)
+		}
+
+		scope := pkg.Types.Scope()
+		names := scope.Names()
+		sort.Strings(names)
+
+		fmt.Printf("%s:\n", path)
+		for _, name := range names {
+			if !ast.IsExported(name) {
+				continue
+			}
+			obj, ok := scope.Lookup(name).(*types.TypeName)
+			if !ok {
+				continue
+			}
+			typ := obj.Type()
+
+			switch {
+			case types.Implements(typ, iface):
+				fmt.Printf("\t%s\n", name)
+			case types.Implements(types.NewPointer(typ), iface):
+				fmt.Printf("\t*%s\n", name)
+			}
+		}
+	}
+}
+
+// writeFile renders the computed interface as a complete, gofmt'd Go source
+// file containing a "type name interface { ... }" declaration, and writes it
+// to path. If fake is non-empty, a counterfeiter-style test double named fake
+// implementing the interface is appended, in fakePkgName's package if given.
+func writeFile(path, pkgName, name, fake, fakePkgName string, full, printed map[string]fn, names []string, embeds []embedCandidate, typs []types.Type, byTypes map[*types.Package]*packages.Package) error {
+	if pkgName == "" {
+		pkgName = filepath.Base(filepath.Dir(path))
+		if pkgName == "." || pkgName == string(filepath.Separator) {
+			pkgName = "main"
+		}
+	}
+	if fake != "" && fakePkgName != "" {
+		pkgName = fakePkgName
+	}
+
+	q := newQualifier(pkgName)
+
+	buf := &bytes.Buffer{}
+	if *header {
+		fmt.Fprintln(buf, "// Common interface of")
+		for _, line := range implementorLines(full, typs) {
+			fmt.Fprintf(buf, "// %s\n", line)
+		}
+	}
+	fmt.Fprintf(buf, "type %s interface {\n", name)
+	for _, e := range embeds {
+		fmt.Fprintln(buf, e.qualifiedName(q.qualify))
+	}
+	for _, mname := range names {
+		method := printed[mname]
 
-		// Add doc comment, if requested.
 		if *comments {
 			pos := method.Obj.Pos()
-			_, path, _ := prog.PathEnclosingInterval(pos, pos)
-
-			for _, node := range path[:len(path)-1] {
-				var doc *ast.CommentGroup
-				switch node := node.(type) {
-				case *ast.FuncDecl:
-					doc = node.Doc
-				case *ast.Field:
-					doc = node.Doc
-				}
-				if doc != nil {
+			if pkg := byTypes[method.Obj.Pkg()]; pkg != nil {
+				if doc := enclosingDoc(pkg, pos); doc != nil {
 					for _, comment := range doc.List {
 						fmt.Fprintln(buf, comment.Text)
 					}
-					break
 				}
 			}
 		}
 
-		// Add the function signature.
-		sig := types.TypeString(method.Signature, (*types.Package).Name)
-		fmt.Fprintf(buf, "\t%s%s\n", name, strings.TrimPrefix(sig, "func"))
+		sig := types.TypeString(method.Signature, q.qualify)
+		fmt.Fprintf(buf, "\t%s%s\n", mname, strings.TrimPrefix(sig, "func"))
 	}
+	fmt.Fprintln(buf, "}")
 
-	fmt.Fprintln(buf, `}`)
+	if fake != "" {
+		// The fake must implement every method of the interface, including
+		// ones factored into an embed above, not just the ones printed.
+		fullNames := make([]string, 0, len(full))
+		for mname := range full {
+			fullNames = append(fullNames, mname)
+		}
+		sort.Strings(fullNames)
 
-	// Pretty-print the buffer, unless we get an error.
-	src := buf.Bytes()
-	if src2, err := format.Source(src); err == nil {
-		src = src2
+		fmt.Fprintln(buf)
+		fmt.Fprint(buf, fakeCode(q, name, fake, full, fullNames))
 	}
 
-	// Remove package header again so only the interface type itself remains.
-	idx := bytes.Index(src, []byte("interface"))
-	if idx >= 0 {
-		src = src[idx:]
+	src := &bytes.Buffer{}
+	fmt.Fprintf(src, "package %s\n\n", pkgName)
+	if imports := q.importBlock(); imports != "" {
+		fmt.Fprintf(src, "import (\n%s)\n\n", imports)
 	}
+	src.Write(buf.Bytes())
 
-	// Print a header, if requested.
-	if *header {
-		// Construct an interface type so we can check whether we can omit pointers.
-		funcs := []*types.Func{}
-		// Iterating the map directly is fine because order doesn't matter here.
-		// (NewInterface sorts the methods)
-		for name, method := range common {
-			funcs = append(funcs, types.NewFunc(token.NoPos, nil, name, method.Signature))
+	formatted, err := format.Source(src.Bytes())
+	if err != nil {
+		return fmt.Errorf("formatting generated source: %w", err)
+	}
+	return os.WriteFile(path, formatted, 0o644)
+}
+
+// fakeCode renders a counterfeiter-style test double named fake, implementing
+// the ifaceName interface formed by common, using q to qualify any package
+// referenced by a method's parameter or result types.
+func fakeCode(q *qualifier, ifaceName, fake string, common map[string]fn, names []string) string {
+	syncPkg := q.qualify(types.NewPackage("sync", "sync"))
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "var _ %s = new(%s)\n\n", ifaceName, fake)
+
+	fmt.Fprintf(buf, "type %s struct {\n", fake)
+	for _, name := range names {
+		sig := common[name].Signature
+		field := lowerFirst(name)
+		params := paramTypes(sig.Params(), q)
+		declParams := variadicParamTypes(sig.Params(), q, sig.Variadic())
+		results := paramTypes(sig.Results(), q)
+
+		fmt.Fprintf(buf, "\t%sStub func(%s) (%s)\n\n", name, strings.Join(declParams, ", "), strings.Join(results, ", "))
+		fmt.Fprintf(buf, "\t%sMutex %s.Mutex\n", field, syncPkg)
+		fmt.Fprintf(buf, "\t%sArgsForCall []struct {\n%s\t}\n", field, structFields(params, "arg"))
+		if len(results) > 0 {
+			fmt.Fprintf(buf, "\t%sReturns struct {\n%s\t}\n", field, structFields(results, "result"))
+			fmt.Fprintf(buf, "\t%sReturnsOnCall map[int]struct {\n%s\t}\n", field, structFields(results, "result"))
 		}
-		iface := types.NewInterface(funcs, nil).Complete()
+		fmt.Fprintln(buf)
+	}
+	fmt.Fprintln(buf, "}")
 
-		// Print the actual header.
-		fmt.Println("// Common interface of")
-		for _, typ := range typs {
-			// Don't print a pointer type if the element type implements the interface.
-			if ptr, ok := typ.(*types.Pointer); ok && types.Implements(ptr.Elem(), iface) {
-				typ = ptr.Elem()
+	for _, name := range names {
+		sig := common[name].Signature
+		field := lowerFirst(name)
+		variadic := sig.Variadic()
+		params := paramTypes(sig.Params(), q)
+		declParams := variadicParamTypes(sig.Params(), q, variadic)
+		results := paramTypes(sig.Results(), q)
+		args := argNames(len(params), "arg")
+		rets := argNames(len(results), "result")
+
+		paramDecls := make([]string, len(declParams))
+		for i, p := range declParams {
+			paramDecls[i] = args[i] + " " + p
+		}
+
+		// The final argument of a variadic method must be spread when
+		// forwarded to the stub, since the stub itself is variadic too.
+		callArgs := args
+		if variadic && len(callArgs) > 0 {
+			callArgs = append([]string(nil), args...)
+			callArgs[len(callArgs)-1] += "..."
+		}
+
+		fmt.Fprintf(buf, "\nfunc (fake *%s) %s(%s) (%s) {\n", fake, name, strings.Join(paramDecls, ", "), strings.Join(results, ", "))
+		fmt.Fprintf(buf, "\tfake.%sMutex.Lock()\n", field)
+		if len(results) > 0 {
+			fmt.Fprintf(buf, "\tret, specificReturn := fake.%sReturnsOnCall[len(fake.%sArgsForCall)]\n", field, field)
+		}
+		fmt.Fprintf(buf, "\tfake.%sArgsForCall = append(fake.%sArgsForCall, struct {\n%s\t}{%s})\n",
+			field, field, structFields(params, "arg"), strings.Join(args, ", "))
+		fmt.Fprintf(buf, "\tstub := fake.%sStub\n", name)
+		if len(results) > 0 {
+			fmt.Fprintf(buf, "\tfakeReturns := fake.%sReturns\n", field)
+		}
+		fmt.Fprintf(buf, "\tfake.%sMutex.Unlock()\n", field)
+		fmt.Fprintln(buf, "\tif stub != nil {")
+		fmt.Fprintf(buf, "\t\treturn stub(%s)\n", strings.Join(callArgs, ", "))
+		fmt.Fprintln(buf, "\t}")
+		if len(results) > 0 {
+			fmt.Fprintln(buf, "\tif specificReturn {")
+			fmt.Fprintf(buf, "\t\treturn %s\n", strings.Join(prefixed("ret.", rets), ", "))
+			fmt.Fprintln(buf, "\t}")
+			fmt.Fprintf(buf, "\treturn %s\n", strings.Join(prefixed("fakeReturns.", rets), ", "))
+		}
+		fmt.Fprintln(buf, "}")
+
+		fmt.Fprintf(buf, "\nfunc (fake *%s) %sCallCount() int {\n", fake, name)
+		fmt.Fprintf(buf, "\tfake.%sMutex.Lock()\n\tdefer fake.%sMutex.Unlock()\n", field, field)
+		fmt.Fprintf(buf, "\treturn len(fake.%sArgsForCall)\n}\n", field)
+
+		if len(params) > 0 {
+			fmt.Fprintf(buf, "\nfunc (fake *%s) %sArgsForCall(i int) (%s) {\n", fake, name, strings.Join(params, ", "))
+			fmt.Fprintf(buf, "\tfake.%sMutex.Lock()\n\tdefer fake.%sMutex.Unlock()\n", field, field)
+			fmt.Fprintf(buf, "\targs := fake.%sArgsForCall[i]\n", field)
+			fmt.Fprintf(buf, "\treturn %s\n}\n", strings.Join(prefixed("args.", args), ", "))
+		}
+
+		if len(results) > 0 {
+			retDecls := make([]string, len(results))
+			for i, r := range results {
+				retDecls[i] = rets[i] + " " + r
 			}
 
-			fmt.Printf("// %v\n", typ)
+			fmt.Fprintf(buf, "\nfunc (fake *%s) %sReturns(%s) {\n", fake, name, strings.Join(retDecls, ", "))
+			fmt.Fprintf(buf, "\tfake.%sMutex.Lock()\n\tdefer fake.%sMutex.Unlock()\n", field, field)
+			fmt.Fprintf(buf, "\tfake.%sStub = nil\n", name)
+			fmt.Fprintf(buf, "\tfake.%sReturns = struct {\n%s\t}{%s}\n}\n", field, structFields(results, "result"), strings.Join(rets, ", "))
+
+			fmt.Fprintf(buf, "\nfunc (fake *%s) %sReturnsOnCall(i int, %s) {\n", fake, name, strings.Join(retDecls, ", "))
+			fmt.Fprintf(buf, "\tfake.%sMutex.Lock()\n\tdefer fake.%sMutex.Unlock()\n", field, field)
+			fmt.Fprintf(buf, "\tfake.%sStub = nil\n", name)
+			fmt.Fprintf(buf, "\tif fake.%sReturnsOnCall == nil {\n\t\tfake.%sReturnsOnCall = make(map[int]struct {\n%s\t\t})\n\t}\n",
+				field, field, structFields(results, "result"))
+			fmt.Fprintf(buf, "\tfake.%sReturnsOnCall[i] = struct {\n%s\t}{%s}\n}\n", field, structFields(results, "result"), strings.Join(rets, ", "))
 		}
 	}
 
-	// Print the result.
-	fmt.Printf("%s", src)
+	return buf.String()
+}
+
+// paramTypes renders the rendered type of every element of tuple using q.
+func paramTypes(tuple *types.Tuple, q *qualifier) []string {
+	out := make([]string, tuple.Len())
+	for i := range out {
+		out[i] = types.TypeString(tuple.At(i).Type(), q.qualify)
+	}
+	return out
+}
+
+// variadicParamTypes is like paramTypes, but if variadic is true, renders the
+// final parameter's slice type as "...T" instead of "[]T", matching how a
+// variadic parameter appears in the signature that declares it.
+func variadicParamTypes(tuple *types.Tuple, q *qualifier, variadic bool) []string {
+	out := paramTypes(tuple, q)
+	if variadic && tuple.Len() > 0 {
+		if slice, ok := tuple.At(tuple.Len() - 1).Type().(*types.Slice); ok {
+			out[len(out)-1] = "..." + types.TypeString(slice.Elem(), q.qualify)
+		}
+	}
+	return out
+}
+
+// argNames returns n sequential identifiers prefix1, prefix2, ...
+func argNames(n int, prefix string) []string {
+	out := make([]string, n)
+	for i := range out {
+		out[i] = fmt.Sprintf("%s%d", prefix, i+1)
+	}
+	return out
+}
+
+// structFields renders "\tprefixN type\n" for each type, for use as the body
+// of an anonymous struct literal.
+func structFields(fieldTypes []string, prefix string) string {
+	buf := &bytes.Buffer{}
+	for i, typ := range fieldTypes {
+		fmt.Fprintf(buf, "\t\t%s%d %s\n", prefix, i+1, typ)
+	}
+	return buf.String()
+}
+
+// prefixed returns a copy of names with prefix prepended to each element.
+func prefixed(prefix string, names []string) []string {
+	out := make([]string, len(names))
+	for i, name := range names {
+		out[i] = prefix + name
+	}
+	return out
+}
+
+// lowerFirst lower-cases the first rune of s, for deriving an unexported
+// field name from an exported method name.
+func lowerFirst(s string) string {
+	if s == "" {
+		return s
+	}
+	r := []rune(s)
+	r[0] = unicode.ToLower(r[0])
+	return string(r)
+}
+
+// qualifier is a types.Qualifier that records every package it is asked to
+// qualify, assigning import aliases to avoid name collisions.
+type qualifier struct {
+	pkgName string
+
+	name2path map[string]string // import name or alias -> import path
+	path2name map[string]string // import path -> original package name
+	alias     map[string]string // import path -> name or alias used in output
+}
+
+func newQualifier(pkgName string) *qualifier {
+	return &qualifier{
+		pkgName:   pkgName,
+		name2path: map[string]string{pkgName: ""},
+		path2name: map[string]string{},
+		alias:     map[string]string{},
+	}
+}
+
+// qualify is a types.Qualifier. It returns the identifier that should be used
+// to refer to pkg in the generated source, registering an import (and, if
+// necessary, an alias) for it.
+func (q *qualifier) qualify(pkg *types.Package) string {
+	if pkg == nil || pkg.Path() == "" {
+		return ""
+	}
+	path := pkg.Path()
+	if used, ok := q.alias[path]; ok {
+		return used
+	}
+
+	name := pkg.Name()
+	used := name
+	if owner, taken := q.name2path[used]; taken && owner != path {
+		used = strings.NewReplacer("/", "_", ".", "_", "-", "_").Replace(path)
+	}
+
+	q.name2path[used] = path
+	q.path2name[path] = name
+	q.alias[path] = used
+	return used
+}
+
+// importBlock renders the gofmt-ready body of an import(...) block for every
+// package registered with qualify so far.
+func (q *qualifier) importBlock() string {
+	paths := make([]string, 0, len(q.path2name))
+	for path := range q.path2name {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	buf := &bytes.Buffer{}
+	for _, path := range paths {
+		if used := q.alias[path]; used != q.path2name[path] {
+			fmt.Fprintf(buf, "\t%s %q\n", used, path)
+		} else {
+			fmt.Fprintf(buf, "\t%q\n", path)
+		}
+	}
+	return buf.String()
+}
+
+// enclosingDoc returns the doc comment, if any, attached to the declaration
+// enclosing pos within pkg.
+func enclosingDoc(pkg *packages.Package, pos token.Pos) *ast.CommentGroup {
+	tokFile := pkg.Fset.File(pos)
+	if tokFile == nil {
+		return nil
+	}
+	for _, f := range pkg.Syntax {
+		if pkg.Fset.File(f.Pos()) != tokFile {
+			continue
+		}
+		path, _ := astutil.PathEnclosingInterval(f, pos, pos)
+		for _, node := range path {
+			switch node := node.(type) {
+			case *ast.FuncDecl:
+				if node.Doc != nil {
+					return node.Doc
+				}
+			case *ast.Field:
+				if node.Doc != nil {
+					return node.Doc
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// loadOverlay reads a JSON overlay file in the format accepted by
+// 'go build -overlay': a {"Replace": {"path": "replacement"}} object mapping
+// each real file to the file whose contents should be used instead.
+func loadOverlay(path string) (map[string][]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var parsed struct {
+		Replace map[string]string
+	}
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	overlay := make(map[string][]byte, len(parsed.Replace))
+	for file, replacement := range parsed.Replace {
+		contents, err := os.ReadFile(replacement)
+		if err != nil {
+			return nil, err
+		}
+		overlay[file] = contents
+	}
+	return overlay, nil
 }
 
 type fn struct {
@@ -226,7 +892,191 @@ type fn struct {
 	Obj       types.Object
 }
 
+// splitPackageList splits a comma-separated flag value into package paths,
+// also appending them to patterns so they get loaded. Returns nil if list is
+// empty.
+func splitPackageList(list string, patterns *[]string) []string {
+	if list == "" {
+		return nil
+	}
+	pkgs := []string{}
+	for _, pkg := range strings.Split(list, ",") {
+		pkg = strings.TrimSpace(pkg)
+		pkgs = append(pkgs, pkg)
+		*patterns = append(*patterns, pkg)
+	}
+	return pkgs
+}
+
 func usage() {
 	fmt.Fprintf(os.Stderr, "Usage: %s [flags] [package].[type] ([package].[type]...)\n", os.Args[0])
 	flag.PrintDefaults()
 }
+
+// typeArgPackages returns the name of every package referenced by a selector
+// expression (e.g. "io" in "io.Reader") among targs' comma-separated type
+// arguments, so the caller can ensure those packages are among the patterns
+// passed to packages.Load.
+func typeArgPackages(targs string) ([]string, error) {
+	var pkgs []string
+	for _, src := range splitTopLevel(targs, ',') {
+		expr, err := parser.ParseExpr(src)
+		if err != nil {
+			return nil, fmt.Errorf("parsing type argument %q: %w", src, err)
+		}
+		ast.Inspect(expr, func(n ast.Node) bool {
+			sel, ok := n.(*ast.SelectorExpr)
+			if !ok {
+				return true
+			}
+			if ident, ok := sel.X.(*ast.Ident); ok {
+				pkgs = append(pkgs, ident.Name)
+			}
+			return true
+		})
+	}
+	return pkgs, nil
+}
+
+// instantiate resolves a generic named type's type arguments and returns the
+// instantiated type. targs is the raw, comma-separated text between the
+// brackets on the command line (e.g. "int, string"), or empty to fall back to
+// a representative type for each type parameter's constraint.
+func instantiate(named *types.Named, targs string, home *types.Package, byName map[string]*types.Package) (types.Type, error) {
+	tparams := named.TypeParams()
+
+	var args []types.Type
+	if targs != "" {
+		for _, src := range splitTopLevel(targs, ',') {
+			expr, err := parser.ParseExpr(src)
+			if err != nil {
+				return nil, fmt.Errorf("parsing type argument %q: %w", src, err)
+			}
+			arg, err := resolveTypeExpr(expr, home, byName)
+			if err != nil {
+				return nil, fmt.Errorf("resolving type argument %q: %w", src, err)
+			}
+			args = append(args, arg)
+		}
+		if len(args) != tparams.Len() {
+			return nil, fmt.Errorf("got %d type arguments, want %d", len(args), tparams.Len())
+		}
+	} else {
+		for i := 0; i < tparams.Len(); i++ {
+			iface, _ := tparams.At(i).Constraint().Underlying().(*types.Interface)
+			repr, ok := representativeType(iface)
+			if !ok {
+				return nil, fmt.Errorf("cannot infer type argument %d; pass it explicitly as %s[...]", i+1, named.Obj().Name())
+			}
+			args = append(args, repr)
+		}
+	}
+
+	return types.Instantiate(types.NewContext(), named, args, true)
+}
+
+// representativeType picks an arbitrary concrete type from iface's type set,
+// for use as a stand-in type argument when none was given explicitly.
+func representativeType(iface *types.Interface) (types.Type, bool) {
+	if iface == nil {
+		return nil, false
+	}
+	for i := 0; i < iface.NumEmbeddeds(); i++ {
+		switch t := iface.EmbeddedType(i).(type) {
+		case *types.Union:
+			if t.Len() > 0 {
+				return t.Term(0).Type(), true
+			}
+		default:
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+// resolveTypeExpr resolves a parsed type expression, such as "int" or
+// "io.Writer", to a types.Type. home is the package the expression is
+// considered to be written in, for resolving unqualified identifiers that
+// name a type local to it. byName maps loaded packages by name, for
+// resolving selector expressions.
+func resolveTypeExpr(expr ast.Expr, home *types.Package, byName map[string]*types.Package) (types.Type, error) {
+	switch e := expr.(type) {
+	case *ast.Ident:
+		if obj := types.Universe.Lookup(e.Name); obj != nil {
+			if tn, ok := obj.(*types.TypeName); ok {
+				return tn.Type(), nil
+			}
+		}
+		if home != nil {
+			if obj := home.Scope().Lookup(e.Name); obj != nil {
+				if tn, ok := obj.(*types.TypeName); ok {
+					return tn.Type(), nil
+				}
+			}
+		}
+		return nil, fmt.Errorf("unknown type %q", e.Name)
+
+	case *ast.SelectorExpr:
+		pkgIdent, ok := e.X.(*ast.Ident)
+		if !ok {
+			return nil, fmt.Errorf("unsupported type argument syntax %T", expr)
+		}
+		pkg, ok := byName[pkgIdent.Name]
+		if !ok {
+			return nil, fmt.Errorf("unknown package %q", pkgIdent.Name)
+		}
+		obj := pkg.Scope().Lookup(e.Sel.Name)
+		if obj == nil {
+			return nil, fmt.Errorf("unknown type %q in package %q", e.Sel.Name, pkgIdent.Name)
+		}
+		tn, ok := obj.(*types.TypeName)
+		if !ok {
+			return nil, fmt.Errorf("%s.%s is not a type", pkgIdent.Name, e.Sel.Name)
+		}
+		return tn.Type(), nil
+
+	case *ast.StarExpr:
+		elem, err := resolveTypeExpr(e.X, home, byName)
+		if err != nil {
+			return nil, err
+		}
+		return types.NewPointer(elem), nil
+
+	case *ast.ArrayType:
+		if e.Len != nil {
+			return nil, fmt.Errorf("array type arguments are not supported, only slices")
+		}
+		elem, err := resolveTypeExpr(e.Elt, home, byName)
+		if err != nil {
+			return nil, err
+		}
+		return types.NewSlice(elem), nil
+
+	default:
+		return nil, fmt.Errorf("unsupported type argument syntax %T", expr)
+	}
+}
+
+// splitTopLevel splits s on sep, ignoring any sep that's nested inside
+// brackets, so that e.g. a type argument like "Pair[int, string]" isn't
+// split in the middle.
+func splitTopLevel(s string, sep byte) []string {
+	var parts []string
+	depth := 0
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '[', '(', '{':
+			depth++
+		case ']', ')', '}':
+			depth--
+		case sep:
+			if depth == 0 {
+				parts = append(parts, strings.TrimSpace(s[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	parts = append(parts, strings.TrimSpace(s[start:]))
+	return parts
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"go/parser"
+	"go/token"
+	"go/types"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// TestFakeCodeVariadic guards against regressing the fake generated for a
+// variadic method back to a plain slice parameter, which fails to satisfy
+// the interface it's meant to implement.
+func TestFakeCodeVariadic(t *testing.T) {
+	params := types.NewTuple(
+		types.NewVar(token.NoPos, nil, "format", types.Typ[types.String]),
+		types.NewVar(token.NoPos, nil, "args", types.NewSlice(types.NewInterfaceType(nil, nil))),
+	)
+	results := types.NewTuple(
+		types.NewVar(token.NoPos, nil, "", types.Typ[types.Int]),
+	)
+	sig := types.NewSignatureType(nil, nil, nil, params, results, true)
+	obj := types.NewFunc(token.NoPos, nil, "Printf", sig)
+
+	common := map[string]fn{"Printf": {Signature: sig, Obj: obj}}
+	q := newQualifier("p")
+	code := fakeCode(q, "Printer", "FakePrinter", common, []string{"Printf"})
+
+	if want := "PrintfStub func(string, ...interface{}) (int)"; !strings.Contains(code, want) {
+		t.Errorf("stub field is not variadic; want substring %q, got:\n%s", want, code)
+	}
+	if want := "func (fake *FakePrinter) Printf(arg1 string, arg2 ...interface{}) (int) {"; !strings.Contains(code, want) {
+		t.Errorf("generated method is not variadic; want substring %q, got:\n%s", want, code)
+	}
+	if want := "stub(arg1, arg2...)"; !strings.Contains(code, want) {
+		t.Errorf("generated method does not spread the variadic argument when calling the stub; want substring %q, got:\n%s", want, code)
+	}
+
+	src := "package p\n\nimport \"sync\"\n\n" + code
+	if _, err := parser.ParseFile(token.NewFileSet(), "fake.go", src, 0); err != nil {
+		t.Fatalf("generated fake is not syntactically valid Go: %v\n%s", err, src)
+	}
+}
+
+// newTestNamed returns a struct type named typeName in pkg, with a
+// no-argument, no-result method for each of methodNames.
+func newTestNamed(pkg *types.Package, typeName string, methodNames ...string) *types.Named {
+	named := types.NewNamed(types.NewTypeName(token.NoPos, pkg, typeName, nil), types.NewStruct(nil, nil), nil)
+	for _, m := range methodNames {
+		recv := types.NewVar(token.NoPos, pkg, "", named)
+		sig := types.NewSignatureType(recv, nil, nil, nil, nil, false)
+		named.AddMethod(types.NewFunc(token.NoPos, pkg, m, sig))
+	}
+	return named
+}
+
+// TestCommonMethodsUnexported covers the samePkg check in commonMethods: an
+// unexported method is only part of the common set if every type sharing its
+// name also shares its package, since an unexported foo() on two types from
+// different packages is never interchangeable.
+func TestCommonMethodsUnexported(t *testing.T) {
+	pkgA := types.NewPackage("a", "a")
+	pkgB := types.NewPackage("b", "b")
+
+	tests := []struct {
+		name string
+		typs []types.Type
+		want []string
+	}{
+		{
+			name: "different packages drop the unexported method",
+			typs: []types.Type{
+				newTestNamed(pkgA, "Foo", "Bar", "helper"),
+				newTestNamed(pkgB, "Baz", "Bar", "helper"),
+			},
+			want: []string{"Bar"},
+		},
+		{
+			name: "same package keeps the unexported method",
+			typs: []types.Type{
+				newTestNamed(pkgA, "Foo", "Bar", "helper"),
+				newTestNamed(pkgA, "Qux", "Bar", "helper"),
+			},
+			want: []string{"Bar", "helper"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			common := commonMethods(test.typs, true)
+			var got []string
+			for name := range common {
+				got = append(got, name)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("commonMethods() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// TestCommonMethodsBytesBufioReader regression-tests the bytes.Reader /
+// bufio.Reader example from the package doc comment, now that packages are
+// loaded via go/packages instead of go/loader.
+func TestCommonMethodsBytesBufioReader(t *testing.T) {
+	cfg := &packages.Config{
+		Mode: packages.NeedName | packages.NeedTypes | packages.NeedTypesInfo,
+	}
+	pkgs, err := packages.Load(cfg, "bytes", "bufio")
+	if err != nil {
+		t.Fatalf("loading packages: %v", err)
+	}
+	if packages.PrintErrors(pkgs) > 0 {
+		t.Fatal("errors loading packages")
+	}
+
+	var typs []types.Type
+	for _, pkg := range pkgs {
+		obj := pkg.Types.Scope().Lookup("Reader")
+		if obj == nil {
+			t.Fatalf("%s.Reader not found", pkg.PkgPath)
+		}
+		typs = append(typs, obj.Type())
+	}
+
+	common := commonMethods(typs, false)
+	var got []string
+	for name := range common {
+		got = append(got, name)
+	}
+	sort.Strings(got)
+
+	want := []string{"Read", "ReadByte", "ReadRune", "UnreadByte", "UnreadRune", "WriteTo"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("commonMethods(bytes.Reader, bufio.Reader) = %v, want %v", got, want)
+	}
+}
+
+// TestTypeArgPackages guards against regressing package-qualified type
+// arguments, such as the "io" in "Queue[io.Reader]", back to silently
+// depending on the home package's own imports to be loaded.
+func TestTypeArgPackages(t *testing.T) {
+	tests := []struct {
+		targs string
+		want  []string
+	}{
+		{"int", nil},
+		{"io.Reader", []string{"io"}},
+		{"*io.Reader", []string{"io"}},
+		{"[]io.Reader", []string{"io"}},
+		{"io.Reader, sync.Mutex", []string{"io", "sync"}},
+		{"Pair[io.Reader, int]", []string{"io"}},
+	}
+	for _, test := range tests {
+		got, err := typeArgPackages(test.targs)
+		if err != nil {
+			t.Errorf("typeArgPackages(%q): %v", test.targs, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("typeArgPackages(%q) = %v, want %v", test.targs, got, test.want)
+		}
+	}
+}